@@ -1,5 +1,5 @@
 // pathtree implements a tree for storing and looking up paths. It supports
-// wildcard expansions.
+// wildcard expansions and a trailing catch-all expansion.
 //
 // Errata
 //
@@ -8,34 +8,55 @@ package pathtree
 
 import (
 	"errors"
+	"regexp"
 	"sort"
 	"strings"
 )
 
 type Node struct {
-	edges    []*edge // the various path elements leading out of this node.
-	wildcard *Node   // if set, this node had a wildcard as its path element.
-	leaf     *Leaf   // if set, this is a terminal node for this leaf.
-	leafs    int     // counter for # leafs in the tree
+	edges         []*edge         // compressed static edges leading out of this node, sorted by descending priority.
+	staticIndices []byte          // first byte of each edge's leading segment, parallel to edges, for fast dispatch.
+	wildcards     []*wildcardEdge // regex-constrained wildcards, in insertion order.
+	wildcard      *Node           // if set, this node had an unconstrained wildcard as its path element.
+	wildcardName  string          // the name of the unconstrained wildcard, if any.
+	catchall      *Node           // if set, this node had a catch-all as its path element.
+	leaf          *Leaf           // if set, this is a terminal node for this leaf.
 }
 
 type Leaf struct {
 	Value     interface{} // the value associated with this node
 	Wildcards []string    // the wildcard names, in order they appear in the path
-	order     int         // the order this leaf was added
 }
 
+// edge is a compressed run of one or more static path segments leading to a
+// child node. priority counts how many Adds have traversed it, so that
+// edges can be kept ordered with the hottest routes checked first.
 type edge struct {
-	name string
-	node *Node
+	segments []string
+	priority int
+	node     *Node
 }
 
-type byName []*edge
+// matches reports whether elements begins with e's segments, and if so
+// returns the elements remaining after them.
+func (e *edge) matches(elements []string) (rest []string, ok bool) {
+	if len(elements) < len(e.segments) {
+		return nil, false
+	}
+	for i, seg := range e.segments {
+		if elements[i] != seg {
+			return nil, false
+		}
+	}
+	return elements[len(e.segments):], true
+}
 
-func (e byName) Search(k string) (i int, found bool) {
-	i = sort.Search(len(e), func(i int) bool { return e[i].name >= k })
-	found = i < len(e) && e[i].name == k
-	return
+// wildcardEdge is a wildcard constrained to only match elements accepted by
+// regex, e.g. the ":id" in "/user/:id([0-9]+)".
+type wildcardEdge struct {
+	name  string
+	regex *regexp.Regexp
+	node  *Node
 }
 
 func New() *Node {
@@ -46,53 +67,334 @@ func New() *Node {
 // key must begin with "/"
 // Returns an error if:
 // - the key is a duplicate
+// - the key has a catch-all (*name) element that is not the last element
+// - the key has a wildcard (:name(regex)) with an invalid regex
+// - the key has a wildcard element that mixes a regex with a literal
+//   suffix or a second wildcard within the same segment
+// An element that does not begin with ':' or '*' is a static element and is
+// matched literally, even if it contains a ":name(regex)" after a literal
+// prefix; no error is returned for it.
 func (n *Node) Add(key string, val interface{}) error {
 	if key[0] != '/' {
 		return errors.New("Path must begin with /")
 	}
-	n.leafs++
-	return n.add(n.leafs, splitPath(key), nil, val)
+	return n.add(splitPath(key), nil, val)
 }
 
-func (n *Node) add(order int, elements, wildcards []string, val interface{}) error {
+func (n *Node) add(elements, wildcards []string, val interface{}) error {
 	if len(elements) == 0 {
 		if n.leaf != nil {
 			return errors.New("duplicate path")
 		}
 		n.leaf = &Leaf{
-			order:     order,
 			Value:     val,
 			Wildcards: wildcards,
 		}
 		return nil
 	}
 
-	var el string
-	el, elements = elements[0], elements[1:]
+	el := elements[0]
+
+	if el[0] == '*' {
+		if len(elements) != 1 {
+			return errors.New("catch-all must be the last element in the path")
+		}
+		if n.catchall == nil {
+			n.catchall = New()
+		}
+		if n.catchall.leaf != nil {
+			return errors.New("duplicate path")
+		}
+		n.catchall.leaf = &Leaf{
+			Value:     val,
+			Wildcards: append(wildcards, el[1:]),
+		}
+		return nil
+	}
+
+	if el[0] == ':' {
+		name, pattern, err := splitWildcard(el)
+		if err != nil {
+			return err
+		}
+		rest := elements[1:]
+		if pattern == "" {
+			if n.wildcard == nil {
+				n.wildcard = New()
+				n.wildcardName = name
+			}
+			return n.wildcard.add(rest, append(wildcards, name), val)
+		}
+
+		we, err := n.findWildcardEdge(name, pattern)
+		if err != nil {
+			return errors.New("invalid wildcard regex in " + el + ": " + err.Error())
+		}
+		if we == nil {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return errors.New("invalid wildcard regex in " + el + ": " + err.Error())
+			}
+			we = &wildcardEdge{name: name, regex: re, node: New()}
+			n.wildcards = append(n.wildcards, we)
+		}
+		return we.node.add(rest, append(wildcards, name), val)
+	}
+
+	runLen := staticRunLength(elements)
+	run := elements[:runLen]
+
+	for i, e := range n.edges {
+		if n.staticIndices[i] != run[0][0] || e.segments[0] != run[0] {
+			continue
+		}
+
+		common := commonSegments(e.segments, run)
+		if common < len(e.segments) {
+			mid := New()
+			mid.edges = []*edge{{segments: e.segments[common:], priority: e.priority, node: e.node}}
+			mid.reindex()
+			e.segments = e.segments[:common]
+			e.node = mid
+		}
+		e.priority++
+		n.reindex()
+		return e.node.add(elements[common:], wildcards, val)
+	}
+
+	newNode := New()
+	n.edges = append(n.edges, &edge{segments: append([]string{}, run...), priority: 1, node: newNode})
+	n.reindex()
+	return newNode.add(elements[runLen:], wildcards, val)
+}
+
+// reindex sorts n's edges by descending priority and rebuilds staticIndices
+// to match, so Find can dispatch on an edge's leading byte.
+func (n *Node) reindex() {
+	sort.SliceStable(n.edges, func(i, j int) bool { return n.edges[i].priority > n.edges[j].priority })
+	n.staticIndices = make([]byte, len(n.edges))
+	for i, e := range n.edges {
+		n.staticIndices[i] = e.segments[0][0]
+	}
+}
+
+// staticRunLength returns the number of leading elements that are static,
+// i.e. not a wildcard or catch-all.
+func staticRunLength(elements []string) int {
+	i := 0
+	for i < len(elements) && elements[i][0] != ':' && elements[i][0] != '*' {
+		i++
+	}
+	return i
+}
+
+// commonSegments returns the number of leading elements a and b have in
+// common.
+func commonSegments(a, b []string) int {
+	max := len(a)
+	if len(b) < max {
+		max = len(b)
+	}
+	i := 0
+	for i < max && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Remove a path from the tree, pruning any interior nodes left empty by its
+// removal.
+// key must begin with "/"
+// Returns an error if the key does not exist in the tree.
+func (n *Node) Remove(key string) error {
+	if key[0] != '/' {
+		return errors.New("Path must begin with /")
+	}
+	_, err := n.remove(splitPath(key))
+	return err
+}
+
+func (n *Node) remove(elements []string) (pruned bool, err error) {
+	if len(elements) == 0 {
+		if n.leaf == nil {
+			return false, errors.New("path not found")
+		}
+		n.leaf = nil
+		return n.isEmpty(), nil
+	}
+
+	el := elements[0]
+
+	if el[0] == '*' {
+		if n.catchall == nil || len(elements) != 1 {
+			return false, errors.New("path not found")
+		}
+		n.catchall = nil
+		return n.isEmpty(), nil
+	}
 
 	if el[0] == ':' {
-		if n.wildcard == nil {
-			n.wildcard = New()
+		name, pattern, err := splitWildcard(el)
+		if err != nil {
+			return false, err
+		}
+		rest := elements[1:]
+		if pattern == "" {
+			if n.wildcard == nil {
+				return false, errors.New("path not found")
+			}
+			if pruned, err := n.wildcard.remove(rest); err != nil {
+				return false, err
+			} else if pruned {
+				n.wildcard = nil
+			}
+			return n.isEmpty(), nil
+		}
+
+		we, err := n.findWildcardEdge(name, pattern)
+		if err != nil {
+			return false, err
+		}
+		if we == nil {
+			return false, errors.New("path not found")
+		}
+		pruned, err := we.node.remove(rest)
+		if err != nil {
+			return false, err
+		}
+		if pruned {
+			n.wildcards = removeWildcardEdge(n.wildcards, we)
+		}
+		return n.isEmpty(), nil
+	}
+
+	for i, e := range n.edges {
+		if n.staticIndices[i] != el[0] || e.segments[0] != el {
+			continue
+		}
+		rest, ok := e.matches(elements)
+		if !ok {
+			return false, errors.New("path not found")
+		}
+		pruned, err := e.node.remove(rest)
+		if err != nil {
+			return false, err
+		}
+		if pruned {
+			n.edges = append(n.edges[:i], n.edges[i+1:]...)
+			n.reindex()
+		}
+		return n.isEmpty(), nil
+	}
+	return false, errors.New("path not found")
+}
+
+// isEmpty reports whether n has no leaf, children or wildcards left, meaning
+// it can be pruned from its parent.
+func (n *Node) isEmpty() bool {
+	return n.leaf == nil && len(n.edges) == 0 && len(n.wildcards) == 0 &&
+		n.wildcard == nil && n.catchall == nil
+}
+
+func removeWildcardEdge(edges []*wildcardEdge, target *wildcardEdge) []*wildcardEdge {
+	for i, we := range edges {
+		if we == target {
+			return append(edges[:i], edges[i+1:]...)
+		}
+	}
+	return edges
+}
+
+// findWildcardEdge returns the wildcard edge at n matching name and pattern,
+// or nil if there is none.
+func (n *Node) findWildcardEdge(name, pattern string) (*wildcardEdge, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	for _, we := range n.wildcards {
+		if we.name == name && we.regex.String() == re.String() {
+			return we, nil
+		}
+	}
+	return nil, nil
+}
+
+// Update replaces the value associated with an existing path without
+// otherwise disturbing the tree: the path's Wildcards and its position
+// among the static edges and wildcards it passes through are unchanged.
+// key must begin with "/"
+// Returns an error if the key does not exist in the tree.
+func (n *Node) Update(key string, val interface{}) error {
+	if key[0] != '/' {
+		return errors.New("Path must begin with /")
+	}
+	node, err := n.locate(splitPath(key))
+	if err != nil {
+		return err
+	}
+	if node.leaf == nil {
+		return errors.New("path not found")
+	}
+	node.leaf.Value = val
+	return nil
+}
+
+// locate walks the tree along the literal elements of a previously Add-ed
+// path (rather than resolving wildcards against concrete values, as find
+// does) and returns the node at the end of it.
+func (n *Node) locate(elements []string) (*Node, error) {
+	if len(elements) == 0 {
+		return n, nil
+	}
+
+	el := elements[0]
+
+	if el[0] == '*' {
+		if n.catchall == nil || len(elements) != 1 {
+			return nil, errors.New("path not found")
 		}
-		return n.wildcard.add(order, elements, append(wildcards, el[1:]), val)
+		return n.catchall, nil
 	}
 
-	var e *Node
-	index, found := byName(n.edges).Search(el)
-	if found {
-		e = n.edges[index].node
-	} else {
-		e = New()
-		n.edges = append(n.edges, nil)
-		copy(n.edges[index+1:], n.edges[index:])
-		n.edges[index] = &edge{name: el, node: e}
+	if el[0] == ':' {
+		name, pattern, err := splitWildcard(el)
+		if err != nil {
+			return nil, err
+		}
+		rest := elements[1:]
+		if pattern == "" {
+			if n.wildcard == nil {
+				return nil, errors.New("path not found")
+			}
+			return n.wildcard.locate(rest)
+		}
+		we, err := n.findWildcardEdge(name, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if we == nil {
+			return nil, errors.New("path not found")
+		}
+		return we.node.locate(rest)
 	}
 
-	return e.add(order, elements, wildcards, val)
+	for i, e := range n.edges {
+		if n.staticIndices[i] != el[0] || e.segments[0] != el {
+			continue
+		}
+		rest, ok := e.matches(elements)
+		if !ok {
+			return nil, errors.New("path not found")
+		}
+		return e.node.locate(rest)
+	}
+	return nil, errors.New("path not found")
 }
 
 // Find a given path. Any wildcards traversed along the way are expanded and
-// returned, along with the value.
+// returned, along with the value. When a static path and a wildcard path
+// both match, the static path always wins.
 func (n *Node) Find(key string) (leaf *Leaf, expansions []string) {
 	if len(key) == 0 || key[0] != '/' {
 		return nil, nil
@@ -110,25 +412,192 @@ func (n *Node) find(elements, exp []string) (leaf *Leaf, expansions []string) {
 		return n.leaf, exp
 	}
 
-	var el string
-	el, elements = elements[0], elements[1:]
+	el := elements[0]
 
-	if index, found := byName(n.edges).Search(el); found {
-		leaf, expansions = n.edges[index].node.find(elements, exp)
+	for i, e := range n.edges {
+		if n.staticIndices[i] != el[0] || e.segments[0] != el {
+			continue
+		}
+		if rest, ok := e.matches(elements); ok {
+			leaf, expansions = e.node.find(rest, exp)
+		}
+		break
 	}
-	if n.wildcard == nil {
+	if leaf != nil {
 		return
 	}
 
-	exp = append(exp, el)
-	wildcardLeaf, wildcardExpansions := n.wildcard.find(elements, exp)
-	if wildcardLeaf != nil && (leaf == nil || leaf.order > wildcardLeaf.order) {
-		leaf = wildcardLeaf
-		expansions = wildcardExpansions
+	rest := elements[1:]
+
+	for _, we := range n.wildcards {
+		if !we.regex.MatchString(el) {
+			continue
+		}
+		if wildcardLeaf, wildcardExpansions := we.node.find(rest, append(exp, el)); wildcardLeaf != nil {
+			return wildcardLeaf, wildcardExpansions
+		}
+	}
+
+	if n.wildcard != nil {
+		if wildcardLeaf, wildcardExpansions := n.wildcard.find(rest, append(exp, el)); wildcardLeaf != nil {
+			return wildcardLeaf, wildcardExpansions
+		}
+	}
+
+	if n.catchall != nil {
+		leaf = n.catchall.leaf
+		expansions = append(exp, strings.Join(append([]string{el}, rest...), "/"))
 	}
 	return
 }
 
+// splitWildcard splits a ":name" or ":name(regex)" path element into its
+// name and, if present, its regex constraint. A path element holds at most
+// one wildcard, optionally regex-constrained: mixing a literal suffix after
+// the regex, or a second ":name(...)" into the same segment (e.g.
+// ":name(\w+).:ext(jpg|png)") is not implemented, and is rejected with an
+// error rather than silently mis-parsed.
+func splitWildcard(el string) (name, pattern string, err error) {
+	name = el[1:]
+	idx := strings.IndexByte(name, '(')
+	if idx < 0 {
+		return name, "", nil
+	}
+	end := matchingParen(name, idx)
+	if end < 0 {
+		return "", "", errors.New("unterminated wildcard regex in " + el)
+	}
+	if end != len(name)-1 {
+		return "", "", errors.New("mid-segment wildcard composition is not supported in " + el)
+	}
+	return name[:idx], name[idx+1 : end], nil
+}
+
+// matchingParen returns the index in s of the ')' that closes the '(' at
+// position open, or -1 if s has no such closing paren.
+func matchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Walk calls fn once for every leaf in the tree, passing the path it was
+// registered under (reconstructed with its original ":name", ":name(regex)"
+// and "*name" elements) along with the leaf itself. The leaf registered at
+// "/" itself is reported with path "/", not "". An unconstrained ":name"
+// element is reported under the name first added at that position, so a leaf
+// added there under a different name is reported with the first name (its
+// Leaf.Wildcards still hold its own names). Walk stops and returns the error
+// from fn as soon as fn returns a non-nil error.
+func (n *Node) Walk(fn func(path string, leaf *Leaf) error) error {
+	return n.walk("", fn)
+}
+
+func (n *Node) walk(prefix string, fn func(string, *Leaf) error) error {
+	if n.leaf != nil {
+		path := prefix
+		if path == "" {
+			path = "/"
+		}
+		if err := fn(path, n.leaf); err != nil {
+			return err
+		}
+	}
+	for _, e := range n.edges {
+		if err := e.node.walk(prefix+"/"+strings.Join(e.segments, "/"), fn); err != nil {
+			return err
+		}
+	}
+	for _, we := range n.wildcards {
+		pattern := strings.TrimSuffix(strings.TrimPrefix(we.regex.String(), "^(?:"), ")$")
+		if err := we.node.walk(prefix+"/:"+we.name+"("+pattern+")", fn); err != nil {
+			return err
+		}
+	}
+	if n.wildcard != nil {
+		if err := n.wildcard.walk(prefix+"/:"+n.wildcardName, fn); err != nil {
+			return err
+		}
+	}
+	if n.catchall != nil && n.catchall.leaf != nil {
+		var name string
+		if w := n.catchall.leaf.Wildcards; len(w) > 0 {
+			name = w[len(w)-1]
+		}
+		if err := fn(prefix+"/*"+name, n.catchall.leaf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddTree mounts a pre-built subtree under a static prefix, allowing routers
+// to be composed out of independently built pieces.
+// prefix must begin with "/" and must not contain any wildcard or catch-all
+// elements.
+// Returns an error if any leaf in sub collides with a path already
+// registered under prefix.
+func (n *Node) AddTree(prefix string, sub *Node) error {
+	if prefix[0] != '/' {
+		return errors.New("Path must begin with /")
+	}
+	for _, el := range splitPath(prefix) {
+		if el[0] == ':' || el[0] == '*' {
+			return errors.New("AddTree prefix must be static")
+		}
+	}
+
+	type mount struct {
+		path string
+		leaf *Leaf
+	}
+	var mounts []mount
+	if err := sub.Walk(func(path string, leaf *Leaf) error {
+		mounts = append(mounts, mount{path: path, leaf: leaf})
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		full := joinPath(prefix, m.path)
+		if node, err := n.locate(splitPath(full)); err == nil && node.leaf != nil {
+			return errors.New("AddTree: path already exists: " + full)
+		}
+	}
+
+	for _, m := range mounts {
+		if err := n.Add(joinPath(prefix, m.path), m.leaf.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinPath appends a Walk-reconstructed suffix (either "/" for a subtree's
+// own root, or a longer "/"-prefixed path) onto a prefix, without doubling
+// the "/" between them.
+func joinPath(prefix, suffix string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if suffix == "/" {
+		if prefix == "" {
+			return "/"
+		}
+		return prefix
+	}
+	return prefix + suffix
+}
+
 func splitPath(key string) []string {
 	elements := strings.Split(key, "/")
 	if elements[0] == "" {
@@ -0,0 +1,310 @@
+package pathtree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRemoveStatic(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/user/profile", "profile")
+	mustAdd(t, n, "/user/settings", "settings")
+
+	if err := n.Remove("/user/profile"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if leaf, _ := n.Find("/user/profile"); leaf != nil {
+		t.Errorf("Find(/user/profile) = %v, want nil after removal", leaf)
+	}
+	if leaf, _ := n.Find("/user/settings"); leaf == nil || leaf.Value != "settings" {
+		t.Errorf("Find(/user/settings) = %v, want settings", leaf)
+	}
+}
+
+func TestRemoveWildcard(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/user/:name", "byName")
+	mustAdd(t, n, "/user/groups", "groups")
+
+	if err := n.Remove("/user/:name"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if leaf, _ := n.Find("/user/bob"); leaf != nil {
+		t.Errorf("Find(/user/bob) = %v, want nil after removing the wildcard", leaf)
+	}
+	if leaf, _ := n.Find("/user/groups"); leaf == nil || leaf.Value != "groups" {
+		t.Errorf("Find(/user/groups) = %v, want groups", leaf)
+	}
+
+	if err := n.Remove("/user/:name"); err == nil {
+		t.Error("Remove of an already-removed wildcard path should error")
+	}
+}
+
+func TestRemoveRegexWildcard(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/user/:id([0-9]+)", "byID")
+	mustAdd(t, n, "/user/:name", "byName")
+
+	if err := n.Remove("/user/:id([0-9]+)"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if leaf, _ := n.Find("/user/42"); leaf == nil || leaf.Value != "byName" {
+		t.Errorf("Find(/user/42) = %v, want fallback to byName", leaf)
+	}
+}
+
+func TestRemovePrunesInteriorNodes(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/a/b/c", "leaf")
+
+	if err := n.Remove("/a/b/c"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if !n.isEmpty() {
+		t.Errorf("root node should be pruned back to empty, got %+v", n)
+	}
+	if leaf, _ := n.Find("/a/b/c"); leaf != nil {
+		t.Errorf("Find(/a/b/c) = %v, want nil after removal", leaf)
+	}
+}
+
+func TestRemovePrunesOnlyEmptyBranch(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/a/b/c", "c")
+	mustAdd(t, n, "/a/d", "d")
+
+	if err := n.Remove("/a/b/c"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if leaf, _ := n.Find("/a/d"); leaf == nil || leaf.Value != "d" {
+		t.Errorf("Find(/a/d) = %v, want d to survive the removal of a sibling branch", leaf)
+	}
+	if n.isEmpty() {
+		t.Error("root node should not be pruned while /a/d still exists")
+	}
+}
+
+func TestRemoveNotFound(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/a", "a")
+
+	if err := n.Remove("/b"); err == nil {
+		t.Error("Remove of a path that was never added should error")
+	}
+	if err := n.Remove("/a/b"); err == nil {
+		t.Error("Remove of a path longer than any added path should error")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/user/:id([0-9]+)", "old")
+	mustAdd(t, n, "/user/groups", "groupsOld")
+
+	if err := n.Update("/user/:id([0-9]+)", "new"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	leaf, exp := n.Find("/user/42")
+	if leaf == nil || leaf.Value != "new" {
+		t.Errorf("Find(/user/42) = %v, want new", leaf)
+	}
+	if !reflect.DeepEqual(exp, []string{"42"}) {
+		t.Errorf("expansions = %v, want [42]", exp)
+	}
+
+	if err := n.Update("/user/groups", "groupsNew"); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if leaf, _ := n.Find("/user/groups"); leaf == nil || leaf.Value != "groupsNew" {
+		t.Errorf("Find(/user/groups) = %v, want groupsNew", leaf)
+	}
+}
+
+func TestUpdateNotFound(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/a", "a")
+
+	if err := n.Update("/b", "x"); err == nil {
+		t.Error("Update of a path that was never added should error")
+	}
+}
+
+func TestFindCatchAll(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/static/*filepath", "assets")
+
+	leaf, exp := n.Find("/static/css/site.css")
+	if leaf == nil || leaf.Value != "assets" {
+		t.Fatalf("Find(/static/css/site.css) = %v, want assets", leaf)
+	}
+	if !reflect.DeepEqual(exp, []string{"css/site.css"}) {
+		t.Errorf("expansions = %v, want [css/site.css]", exp)
+	}
+
+	if leaf, _ := n.Find("/static"); leaf != nil {
+		t.Errorf("Find(/static) = %v, want nil: catch-all needs at least one element", leaf)
+	}
+}
+
+func TestFindStaticWinsOverWildcard(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/user/:name", "byName")
+	mustAdd(t, n, "/user/profile", "profile")
+
+	if leaf, _ := n.Find("/user/profile"); leaf == nil || leaf.Value != "profile" {
+		t.Errorf("Find(/user/profile) = %v, want the static route to win over :name", leaf)
+	}
+	if leaf, exp := n.Find("/user/bob"); leaf == nil || leaf.Value != "byName" || !reflect.DeepEqual(exp, []string{"bob"}) {
+		t.Errorf("Find(/user/bob) = %v, %v, want byName, [bob]", leaf, exp)
+	}
+}
+
+func TestFindWildcardWinsOverCatchAll(t *testing.T) {
+	n := New()
+	mustAdd(t, n, "/files/:id([0-9]+)", "byID")
+	mustAdd(t, n, "/files/*path", "catchAll")
+
+	if leaf, _ := n.Find("/files/42"); leaf == nil || leaf.Value != "byID" {
+		t.Errorf("Find(/files/42) = %v, want the regex wildcard to win over the catch-all", leaf)
+	}
+	if leaf, _ := n.Find("/files/readme.txt"); leaf == nil || leaf.Value != "catchAll" {
+		t.Errorf("Find(/files/readme.txt) = %v, want catchAll", leaf)
+	}
+}
+
+func TestAddTree(t *testing.T) {
+	sub := New()
+	mustAdd(t, sub, "/", "subRoot")
+	mustAdd(t, sub, "/widgets/:id([0-9]+)", "widget")
+
+	n := New()
+	mustAdd(t, n, "/api/ping", "ping")
+
+	if err := n.AddTree("/api/v2", sub); err != nil {
+		t.Fatalf("AddTree: %v", err)
+	}
+
+	if leaf, _ := n.Find("/api/v2"); leaf == nil || leaf.Value != "subRoot" {
+		t.Errorf("Find(/api/v2) = %v, want subRoot", leaf)
+	}
+	leaf, exp := n.Find("/api/v2/widgets/7")
+	if leaf == nil || leaf.Value != "widget" {
+		t.Errorf("Find(/api/v2/widgets/7) = %v, want widget", leaf)
+	}
+	if !reflect.DeepEqual(exp, []string{"7"}) {
+		t.Errorf("expansions = %v, want [7]", exp)
+	}
+	if leaf, _ := n.Find("/api/ping"); leaf == nil || leaf.Value != "ping" {
+		t.Errorf("Find(/api/ping) = %v, want ping to survive the mount", leaf)
+	}
+}
+
+func TestAddTreeAtRoot(t *testing.T) {
+	sub := New()
+	mustAdd(t, sub, "/status", "status")
+
+	n := New()
+	if err := n.AddTree("/", sub); err != nil {
+		t.Fatalf("AddTree: %v", err)
+	}
+
+	if leaf, _ := n.Find("/status"); leaf == nil || leaf.Value != "status" {
+		t.Errorf("Find(/status) = %v, want status", leaf)
+	}
+}
+
+func TestAddTreeRejectsCollision(t *testing.T) {
+	sub := New()
+	mustAdd(t, sub, "/widgets/:id([0-9]+)", "newWidget")
+
+	n := New()
+	mustAdd(t, n, "/api/widgets/:id([0-9]+)", "oldWidget")
+
+	if err := n.AddTree("/api", sub); err == nil {
+		t.Error("AddTree over a path that already exists should error")
+	}
+	if leaf, _ := n.Find("/api/widgets/7"); leaf == nil || leaf.Value != "oldWidget" {
+		t.Errorf("Find(/api/widgets/7) = %v, want the pre-existing route to survive the rejected AddTree", leaf)
+	}
+}
+
+func mustAdd(t *testing.T, n *Node, key string, val interface{}) {
+	t.Helper()
+	if err := n.Add(key, val); err != nil {
+		t.Fatalf("Add(%q): %v", key, err)
+	}
+}
+
+// benchmarkRoutes builds a realistic, moderately deep set of routes: a mix
+// of static, wildcard and regex-wildcard segments, similar in shape to a
+// typical REST API router.
+func benchmarkRoutes(n int) []string {
+	resources := []string{"users", "orgs", "repos", "teams", "projects", "issues", "comments", "events", "hooks", "releases"}
+	routes := make([]string, 0, n)
+	for i := 0; len(routes) < n; i++ {
+		resource := resources[i%len(resources)]
+		switch i % 4 {
+		case 0:
+			routes = append(routes, "/api/v1/"+resource+"/list")
+		case 1:
+			routes = append(routes, "/api/v1/"+resource+"/:id([0-9]+)")
+		case 2:
+			routes = append(routes, "/api/v1/"+resource+"/:id([0-9]+)/comments")
+		case 3:
+			routes = append(routes, "/api/v1/"+resource+"/:owner/"+resource)
+		}
+		routes[len(routes)-1] += "/" + itoa(i)
+	}
+	return routes
+}
+
+// itoa avoids pulling in strconv just for benchmark route names.
+func itoa(i int) string {
+	if i == 0 {
+		return "0"
+	}
+	var buf [20]byte
+	pos := len(buf)
+	for i > 0 {
+		pos--
+		buf[pos] = byte('0' + i%10)
+		i /= 10
+	}
+	return string(buf[pos:])
+}
+
+func BenchmarkAdd(b *testing.B) {
+	routes := benchmarkRoutes(500)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := New()
+		for _, route := range routes {
+			n.Add(route, route)
+		}
+	}
+}
+
+func BenchmarkFind(b *testing.B) {
+	routes := benchmarkRoutes(500)
+	n := New()
+	for _, route := range routes {
+		if err := n.Add(route, route); err != nil {
+			b.Fatalf("Add(%q): %v", route, err)
+		}
+	}
+	lookups := make([]string, len(routes))
+	for i, route := range routes {
+		lookups[i] = strings.NewReplacer(":id([0-9]+)", "42", ":owner", "alice").Replace(route)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.Find(lookups[i%len(lookups)])
+	}
+}